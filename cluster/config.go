@@ -0,0 +1,9 @@
+package cluster
+
+import "github.com/samalba/dockerclient"
+
+// ContainerConfig is exported. It wraps the docker client version of the
+// same structure.
+type ContainerConfig struct {
+	dockerclient.ContainerConfig
+}
@@ -2,10 +2,14 @@ package filter
 
 import (
 	"fmt"
+	"net"
+	"strconv"
+	"strings"
 
+	"github.com/docker/docker/nat"
 	"github.com/docker/swarm/cluster"
 	"github.com/docker/swarm/scheduler/node"
-	"github.com/docker/docker/nat"
+	"github.com/docker/swarm/scheduler/portalloc"
 	"github.com/samalba/dockerclient"
 )
 
@@ -13,6 +17,17 @@ import (
 // port, only nodes that have not already allocated that same port will be
 // considered.
 type PortFilter struct {
+	// Allocator, if set, pre-assigns a concrete host port for dynamic
+	// bindings (e.g. -p 80) from a configured range, instead of leaving
+	// allocation to the engine. A nil Allocator preserves the original
+	// behavior of letting the engine pick.
+	Allocator portalloc.Allocator
+}
+
+// NewPortFilter returns a PortFilter that pre-assigns dynamic host ports
+// using allocator.
+func NewPortFilter(allocator portalloc.Allocator) *PortFilter {
+	return &PortFilter{Allocator: allocator}
 }
 
 // Name returns the name of the filter
@@ -32,12 +47,21 @@ func (p *PortFilter) Filter(config *cluster.ContainerConfig, nodes []*node.Node)
 func (p *PortFilter) filterHost(config *cluster.ContainerConfig, nodes []*node.Node) ([]*node.Node, error) {
 	for port := range config.ExposedPorts {
 		candidates := []*node.Node{}
-		for _, node := range nodes {
-			if !p.portAlreadyExposed(node, port) {
-				candidates = append(candidates, node)
+		var reservedErr error
+		for _, n := range nodes {
+			if p.portAlreadyExposed(n, port) {
+				continue
+			}
+			if reservedBy, ok := portReserved(n, string(port)); ok {
+				reservedErr = fmt.Errorf("node %s has port %s reserved for the host (%s)", n.ID, port, reservedBy)
+				continue
 			}
+			candidates = append(candidates, n)
 		}
 		if len(candidates) == 0 {
+			if reservedErr != nil {
+				return nil, reservedErr
+			}
 			return nil, fmt.Errorf("unable to find a node with port %s available in the Host mode", port)
 		}
 		nodes = candidates
@@ -45,30 +69,233 @@ func (p *PortFilter) filterHost(config *cluster.ContainerConfig, nodes []*node.N
 	return nodes, nil
 }
 
+// portReserved returns whether requestedPort (e.g. "80/tcp") falls within a
+// range the node, or one of its host networks, has reserved for itself, and
+// the range that reserved it for use in error messages.
+func portReserved(n *node.Node, requestedPort string) (node.PortRange, bool) {
+	portNum, err := strconv.Atoi(strings.SplitN(requestedPort, "/", 2)[0])
+	if err != nil {
+		return node.PortRange{}, false
+	}
+	for _, r := range n.ReservedPorts {
+		if r.Contains(portNum) {
+			return r, true
+		}
+	}
+	for _, hn := range n.HostNetworks {
+		for _, r := range hn.ReservedPorts {
+			if r.Contains(portNum) {
+				return r, true
+			}
+		}
+	}
+	return node.PortRange{}, false
+}
+
+// rangeReserved returns whether [requestedStart, requestedEnd] overlaps a
+// range the node has reserved for itself (interface-agnostic), or one
+// reserved by a host network whose interface addresses overlap
+// requestedIp.
+func rangeReserved(n *node.Node, requestedIp string, requestedStart, requestedEnd int) (node.PortRange, bool) {
+	if requestedStart == 0 && requestedEnd == 0 {
+		return node.PortRange{}, false
+	}
+	overlaps := func(r node.PortRange) bool {
+		return r.Start <= requestedEnd && r.End >= requestedStart
+	}
+	for _, r := range n.ReservedPorts {
+		if overlaps(r) {
+			return r, true
+		}
+	}
+
+	requestedAddr := parseIp(requestedIp)
+	for _, hn := range n.HostNetworks {
+		if !bindsAllInterfaces(requestedIp) && requestedAddr != nil && !hn.HasIP(requestedAddr) {
+			// This host network's ports are only carved out of its own
+			// interfaces; a bind to some other, unrelated interface can't
+			// collide with it.
+			continue
+		}
+		for _, r := range hn.ReservedPorts {
+			if overlaps(r) {
+				return r, true
+			}
+		}
+	}
+	return node.PortRange{}, false
+}
+
+// allocateDynamicPort pre-assigns a concrete host port for a dynamic
+// binding (one whose HostPort was left empty) using p.Allocator. An
+// allocation is tied to the specific node it was made on, so it narrows
+// the candidate set down to that single node.
+func (p *PortFilter) allocateDynamicPort(proto string, nodes []*node.Node) (*node.Node, int, error) {
+	var allocErr error
+	for _, n := range nodes {
+		ports, err := p.Allocator.Allocate(n, proto, 1)
+		if err != nil {
+			allocErr = err
+			continue
+		}
+		return n, ports[0], nil
+	}
+	if allocErr == nil {
+		allocErr = fmt.Errorf("no candidate nodes")
+	}
+	return nil, 0, fmt.Errorf("unable to allocate a dynamic host port: %v", allocErr)
+}
+
+// dynamicBinding is a port binding left for Swarm to pick (e.g. -p 80),
+// deferred until every fixed port and range in the same container has
+// already narrowed the candidate nodes.
+type dynamicBinding struct {
+	bindings []dockerclient.PortBinding
+	index    int
+	proto    string
+}
+
 func (p *PortFilter) filterBridge(config *cluster.ContainerConfig, nodes []*node.Node) ([]*node.Node, error) {
-	for _, port := range config.HostConfig.PortBindings {
-		for _, binding := range port {
+	var dynamic []dynamicBinding
+
+	// config.HostConfig.PortBindings is a map, so its iteration order is
+	// randomized. Fixed ports and ranges are resolved first, regardless of
+	// that order, and dynamic ports are only allocated afterwards -
+	// otherwise whichever binding the map happened to yield first could
+	// pin scheduling to a node that satisfies it but not the others.
+	for containerPort, bindings := range config.HostConfig.PortBindings {
+		proto, _ := nat.SplitProtoPort(string(containerPort))
+		if !isSupportedProto(proto) {
+			return nil, fmt.Errorf("unsupported protocol %q for port %s", proto, containerPort)
+		}
+
+		for i, binding := range bindings {
 			requestedStart, requestedEnd, err := nat.ParsePortRange(binding.HostPort)
 			if err != nil {
 				return nil, err
 			}
+			if requestedStart == 0 && requestedEnd == 0 {
+				if p.Allocator != nil {
+					dynamic = append(dynamic, dynamicBinding{bindings: bindings, index: i, proto: proto})
+				}
+				continue
+			}
+			// A host-port range on a single binding (e.g. 8000-8100:80) maps
+			// one container port, so one free port is picked out of it.
+			size := 1
+
+			usedAll := make(map[int]interface{})
 			candidates := []*node.Node{}
-			for _, node := range nodes {
-				if in_use, err := p.portAlreadyInUse(node, binding.HostIp, requestedStart, requestedEnd); err != nil {
+			var reservedErr error
+			for _, n := range nodes {
+				if r, ok := rangeReserved(n, binding.HostIp, requestedStart, requestedEnd); ok {
+					reservedErr = fmt.Errorf("node %s has ports %s reserved for the host (requested %s)", n.ID, r, binding.HostPort)
+					continue
+				}
+				used, err := p.portAlreadyInUse(n, binding.HostIp, proto, requestedStart, requestedEnd)
+				if err != nil {
 					return nil, err
-				} else if !in_use {
-					candidates = append(candidates, node)
 				}
+				merged := make(map[int]interface{}, len(usedAll)+len(used))
+				for k := range usedAll {
+					merged[k] = true
+				}
+				for k := range used {
+					merged[k.port] = true
+				}
+				if _, ok := firstFreeRun(merged, requestedStart, requestedEnd, size); !ok {
+					// No port of the range is free both on this node and
+					// on the candidates already kept.
+					continue
+				}
+				usedAll = merged
+				candidates = append(candidates, n)
 			}
 			if len(candidates) == 0 {
-				return nil, fmt.Errorf("unable to find a node with port %s available", binding.HostPort)
+				if reservedErr != nil {
+					return nil, reservedErr
+				}
+				return nil, fmt.Errorf("unable to find a node with port %s/%s available", binding.HostPort, proto)
 			}
+
+			chosenStart, ok := firstFreeRun(usedAll, requestedStart, requestedEnd, size)
+			if !ok {
+				return nil, fmt.Errorf("unable to find a free port range of size %d within %s/%s across the candidate nodes", size, binding.HostPort, proto)
+			}
+			if size == 1 {
+				bindings[i].HostPort = strconv.Itoa(chosenStart)
+			} else {
+				bindings[i].HostPort = fmt.Sprintf("%d-%d", chosenStart, chosenStart+size-1)
+			}
+
 			nodes = candidates
 		}
 	}
+
+	var allocated []allocatedPort
+	for _, d := range dynamic {
+		n, port, err := p.allocateDynamicPort(d.proto, nodes)
+		if err != nil {
+			p.releaseAll(allocated)
+			return nil, err
+		}
+		d.bindings[d.index].HostPort = strconv.Itoa(port)
+		allocated = append(allocated, allocatedPort{node: n, proto: d.proto, port: port})
+		nodes = []*node.Node{n}
+	}
+
 	return nodes, nil
 }
 
+// allocatedPort records a single port p.Allocator.Allocate has already
+// handed out during the current Filter call, so it can be released if a
+// later binding in the same call fails to find a node.
+type allocatedPort struct {
+	node  *node.Node
+	proto string
+	port  int
+}
+
+// releaseAll returns every port in allocated back to p.Allocator. It is
+// called to roll back the dynamic ports already allocated for a container
+// when a later dynamic binding in the same Filter call can't be satisfied,
+// so a partially-schedulable container doesn't permanently leak ports out
+// of the configured range.
+func (p *PortFilter) releaseAll(allocated []allocatedPort) {
+	for _, a := range allocated {
+		p.Allocator.Release(a.node, a.proto, []int{a.port})
+	}
+}
+
+// isSupportedProto reports whether proto is one of the protocols Docker's
+// nat package understands for port bindings.
+func isSupportedProto(proto string) bool {
+	switch proto {
+	case "tcp", "udp", "sctp":
+		return true
+	}
+	return false
+}
+
+// firstFreeRun returns the lowest port p in [start, end] such that every
+// port in [p, p+size-1] is absent from used, i.e. a contiguous sub-range of
+// the requested size that is free on every remaining candidate node.
+func firstFreeRun(used map[int]interface{}, start, end, size int) (int, bool) {
+	for p := start; p+size-1 <= end; p++ {
+		free := true
+		for i := 0; i < size; i++ {
+			if _, ok := used[p+i]; ok {
+				free = false
+				break
+			}
+		}
+		if free {
+			return p, true
+		}
+	}
+	return 0, false
+}
+
 func (p *PortFilter) portAlreadyExposed(node *node.Node, requestedPort string) bool {
 	for _, c := range node.Containers {
 		if c.Info.HostConfig.NetworkMode == "host" {
@@ -82,11 +309,22 @@ func (p *PortFilter) portAlreadyExposed(node *node.Node, requestedPort string) b
 	return false
 }
 
-func (p *PortFilter) portAlreadyInUse(node *node.Node, requestedIp string, requestedStart, requestedEnd int) (bool, error) {
+// portKey identifies a single host port/protocol pair. Two bindings on the
+// same port number but different protocols (e.g. 53/tcp and 53/udp) never
+// collide.
+type portKey struct {
+	port  int
+	proto string
+}
+
+// portAlreadyInUse returns the set of port/protocol pairs within
+// [requestedStart, requestedEnd] for requestedProto that are already
+// occupied on node by another container.
+func (p *PortFilter) portAlreadyInUse(node *node.Node, requestedIp, requestedProto string, requestedStart, requestedEnd int) (map[portKey]interface{}, error) {
+	portsInUse := make(map[portKey]interface{})
 	if requestedStart == 0 && requestedEnd == 0 {
-		return false, nil
+		return portsInUse, nil
 	}
-	portsInUse := make(map[int]interface{})
 	for _, c := range node.Containers {
 		// HostConfig.PortBindings contains the requested ports.
 		// NetworkSettings.Ports contains the actual ports.
@@ -100,51 +338,122 @@ func (p *PortFilter) portAlreadyInUse(node *node.Node, requestedIp string, reque
 		//    NetworkSettings.Port will be null and we have to check
 		//    HostConfig.PortBindings to find out the mapping.
 
-		if all_in_use, err := p.compare(portsInUse, requestedIp, requestedStart, requestedEnd, c.Info.HostConfig.PortBindings); err != nil {
-			return false, err
-		} else if all_in_use {
-			return true, nil
+		if err := p.compare(node, portsInUse, requestedIp, requestedProto, requestedStart, requestedEnd, c.Info.HostConfig.PortBindings); err != nil {
+			return nil, err
 		}
-		if all_in_use, err := p.compare(portsInUse, requestedIp, requestedStart, requestedEnd, c.Info.NetworkSettings.Ports); err != nil {
-			return false, err
-		} else if all_in_use {
-			return true, nil
+		if err := p.compare(node, portsInUse, requestedIp, requestedProto, requestedStart, requestedEnd, c.Info.NetworkSettings.Ports); err != nil {
+			return nil, err
 		}
 	}
-	return false, nil
+	return portsInUse, nil
 }
 
-func (p *PortFilter) compare(portsInUse map[int]interface{}, requestedIp string, requestedStart, requestedEnd int, bindings map[string][]dockerclient.PortBinding) (bool, error) {
-	for _, binding := range bindings {
+// compare adds every port of bindings whose protocol matches requestedProto
+// and which overlaps [requestedStart, requestedEnd] and conflicts with
+// requestedIp to portsInUse. Range bindings (bindingStart != bindingEnd)
+// are expanded in full rather than skipped, so a single container bound to
+// a range occupies every port in that range for the purposes of this check.
+func (p *PortFilter) compare(n *node.Node, portsInUse map[portKey]interface{}, requestedIp, requestedProto string, requestedStart, requestedEnd int, bindings map[string][]dockerclient.PortBinding) error {
+	for rawPort, binding := range bindings {
+		bindingProto, _ := nat.SplitProtoPort(string(rawPort))
+		if bindingProto != requestedProto {
+			continue
+		}
 		for _, b := range binding {
 			bindingStart, bindingEnd, err := nat.ParsePortRange(b.HostPort)
 			if err != nil {
-				return false, err
+				return err
 			}
-			if (bindingStart == 0 && bindingEnd == 0) || (bindingStart != bindingEnd) {
+			if bindingStart == 0 && bindingEnd == 0 {
 				// Skip undefined HostPorts. This happens in bindings that
 				// didn't explicitely specify an external port.
-				// Also skip HostPort ranges; rely only on NetworkSettings.Port for this case.
 				continue
 			}
 
-			if bindingStart >= requestedStart && bindingStart <= requestedEnd {
-				// Another container on the same host is binding in the same
-				// port/protocol range.  Verify if they are requesting the same
-				// binding IP, or if the other container is already binding on
-				// every interface.
-				if requestedIp == b.HostIp || bindsAllInterfaces(requestedIp) || bindsAllInterfaces(b.HostIp) {
-					portsInUse[bindingStart] = true
-					if len(portsInUse) >= (requestedEnd - requestedStart + 1) {
-						return true, nil
-					}
+			lo, hi := bindingStart, bindingEnd
+			if requestedStart > lo {
+				lo = requestedStart
+			}
+			if requestedEnd < hi {
+				hi = requestedEnd
+			}
+			if lo > hi {
+				// The binding doesn't overlap the requested window at all.
+				continue
+			}
+
+			// Another container on the same host is binding the same
+			// port/protocol range. Verify if they are requesting the same
+			// binding IP, or if either container is already binding on
+			// every interface.
+			if ipsOverlap(n, requestedIp, b.HostIp) {
+				for port := lo; port <= hi; port++ {
+					portsInUse[portKey{port: port, proto: bindingProto}] = true
 				}
 			}
 		}
 	}
-	return false, nil
+	return nil
 }
 
 func bindsAllInterfaces(hostIp string) bool {
-	return hostIp == "0.0.0.0" || hostIp == ""
+	switch stripBrackets(hostIp) {
+	case "0.0.0.0", "", "::":
+		return true
+	}
+	return false
+}
+
+// stripBrackets removes the brackets nat.ParsePortSpecs leaves around IPv6
+// literals, e.g. "[::1]" -> "::1".
+func stripBrackets(hostIp string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(hostIp, "["), "]")
+}
+
+// parseIp parses hostIp, tolerating the brackets nat.ParsePortSpecs leaves
+// around IPv6 literals. It returns nil if hostIp is empty or malformed.
+func parseIp(hostIp string) net.IP {
+	return net.ParseIP(stripBrackets(hostIp))
+}
+
+// ipsOverlap returns whether two binding host IPs on node n can collide.
+// Two bindings only conflict if they share at least one of n's real
+// interfaces: binding to the same specific address always conflicts, and
+// binding to every interface (the wildcard address) conflicts with a
+// specific address only if that address is actually one of n.HostIPs. If
+// n.HostIPs hasn't been populated yet (the engine hasn't reported its
+// interfaces), we fall back to treating a wildcard as conflicting with
+// anything, since we can't prove otherwise.
+func ipsOverlap(n *node.Node, a, b string) bool {
+	aWild, bWild := bindsAllInterfaces(a), bindsAllInterfaces(b)
+	if aWild && bWild {
+		return true
+	}
+	if aWild {
+		return wildcardOverlaps(n, b)
+	}
+	if bWild {
+		return wildcardOverlaps(n, a)
+	}
+
+	// Comparing parsed net.IP values (rather than raw strings) means
+	// equivalent forms of the same address, e.g. differently-bracketed or
+	// differently-cased IPv6 literals, are correctly recognized as the
+	// same interface instead of treated as distinct ones.
+	ipA, ipB := parseIp(a), parseIp(b)
+	if ipA != nil && ipB != nil {
+		return ipA.Equal(ipB)
+	}
+	return a == b
+}
+
+// wildcardOverlaps returns whether a wildcard bind on n actually covers
+// specificIp, i.e. whether specificIp is one of n's known interfaces.
+func wildcardOverlaps(n *node.Node, specificIp string) bool {
+	if len(n.HostIPs) == 0 {
+		// We don't know the node's interfaces yet; assume the worst.
+		return true
+	}
+	ip := parseIp(specificIp)
+	return ip == nil || n.HasIP(ip)
 }
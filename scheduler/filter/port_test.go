@@ -0,0 +1,377 @@
+package filter
+
+import (
+	"net"
+	"testing"
+
+	"github.com/docker/swarm/cluster"
+	"github.com/docker/swarm/scheduler/node"
+	"github.com/docker/swarm/scheduler/portalloc"
+	"github.com/samalba/dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func bridgeContainer(containerPort, hostPort, proto string) *cluster.Container {
+	return bridgeContainerOnIP(containerPort, "0.0.0.0", hostPort, proto)
+}
+
+func bridgeContainerOnIP(containerPort, hostIp, hostPort, proto string) *cluster.Container {
+	c := &cluster.Container{}
+	c.Info.HostConfig.PortBindings = map[string][]dockerclient.PortBinding{
+		containerPort + "/" + proto: {{HostIp: hostIp, HostPort: hostPort}},
+	}
+	return c
+}
+
+func hostModeContainer(exposedPort string) *cluster.Container {
+	c := &cluster.Container{}
+	c.Info.HostConfig.NetworkMode = "host"
+	c.Info.Config = &dockerclient.ContainerConfig{
+		ExposedPorts: map[string]struct{}{exposedPort: {}},
+	}
+	return c
+}
+
+func bridgeConfig(hostPort, containerPort, proto string) *cluster.ContainerConfig {
+	return bridgeConfigOnIP("", hostPort, containerPort, proto)
+}
+
+func bridgeConfigOnIP(hostIp, hostPort, containerPort, proto string) *cluster.ContainerConfig {
+	config := &cluster.ContainerConfig{}
+	config.HostConfig.PortBindings = map[string][]dockerclient.PortBinding{
+		containerPort + "/" + proto: {{HostIp: hostIp, HostPort: hostPort}},
+	}
+	return config
+}
+
+func hostConfig(exposedPort string) *cluster.ContainerConfig {
+	config := &cluster.ContainerConfig{}
+	config.HostConfig.NetworkMode = "host"
+	config.ExposedPorts = map[string]struct{}{exposedPort: {}}
+	return config
+}
+
+func TestPortFilterBridgeProtocols(t *testing.T) {
+	tests := []struct {
+		name          string
+		existingProto string
+		requestProto  string
+		collides      bool
+	}{
+		{"tcp request collides with tcp in use", "tcp", "tcp", true},
+		{"udp request ignores tcp in use", "tcp", "udp", false},
+		{"sctp request ignores tcp in use", "tcp", "sctp", false},
+		{"sctp request collides with sctp in use", "sctp", "sctp", true},
+		{"tcp request ignores udp in use", "udp", "tcp", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := &node.Node{ID: "node-1"}
+			n.Containers = []*cluster.Container{bridgeContainer("80", "8080", tt.existingProto)}
+
+			p := &PortFilter{}
+			result, err := p.Filter(bridgeConfig("8080", "80", tt.requestProto), []*node.Node{n})
+			if tt.collides {
+				assert.Error(t, err)
+				assert.Len(t, result, 0)
+			} else {
+				assert.NoError(t, err)
+				assert.Len(t, result, 1)
+			}
+		})
+	}
+}
+
+func TestPortFilterHostModeProtocols(t *testing.T) {
+	tests := []struct {
+		name         string
+		existingPort string
+		requestPort  string
+		collides     bool
+	}{
+		{"tcp request collides with tcp in use", "53/tcp", "53/tcp", true},
+		{"udp request ignores tcp in use", "53/tcp", "53/udp", false},
+		{"sctp request ignores tcp in use", "53/tcp", "53/sctp", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := &node.Node{ID: "node-1"}
+			n.Containers = []*cluster.Container{hostModeContainer(tt.existingPort)}
+
+			p := &PortFilter{}
+			result, err := p.Filter(hostConfig(tt.requestPort), []*node.Node{n})
+			if tt.collides {
+				assert.Error(t, err)
+				assert.Len(t, result, 0)
+			} else {
+				assert.NoError(t, err)
+				assert.Len(t, result, 1)
+			}
+		})
+	}
+}
+
+func TestPortFilterBridgeWildcardResolvesAgainstHostIPs(t *testing.T) {
+	tests := []struct {
+		name        string
+		hostIPs     []string
+		requestedIp string
+		collides    bool
+	}{
+		{"wildcard collides with an address the node actually owns", []string{"192.168.1.10", "10.0.0.5"}, "192.168.1.10", true},
+		{"wildcard does not collide with an address the node doesn't own", []string{"192.168.1.10"}, "10.0.0.5", false},
+		{"unknown HostIPs falls back to conservative collision", nil, "10.0.0.5", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := &node.Node{ID: "node-1"}
+			for _, ip := range tt.hostIPs {
+				n.HostIPs = append(n.HostIPs, net.ParseIP(ip))
+			}
+			n.Containers = []*cluster.Container{bridgeContainerOnIP("80", "0.0.0.0", "8080", "tcp")}
+
+			p := &PortFilter{}
+			result, err := p.Filter(bridgeConfigOnIP(tt.requestedIp, "8080", "80", "tcp"), []*node.Node{n})
+			if tt.collides {
+				assert.Error(t, err)
+				assert.Len(t, result, 0)
+			} else {
+				assert.NoError(t, err)
+				assert.Len(t, result, 1)
+			}
+		})
+	}
+}
+
+func TestPortReserved(t *testing.T) {
+	n := &node.Node{
+		ID:            "node-1",
+		ReservedPorts: []node.PortRange{{Start: 8000, End: 8100}},
+		HostNetworks: []node.HostNetwork{
+			{Name: "public", IPs: []string{"192.168.1.10"}, ReservedPorts: []node.PortRange{{Start: 9000, End: 9000}}},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		port     string
+		reserved bool
+	}{
+		{"port within the node's own reserved range", "8050/tcp", true},
+		{"port within a host network's reserved range", "9000/tcp", true},
+		{"port outside every reserved range", "7000/tcp", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, ok := portReserved(n, tt.port)
+			assert.Equal(t, tt.reserved, ok)
+		})
+	}
+}
+
+func TestRangeReserved(t *testing.T) {
+	n := &node.Node{
+		ID:            "node-1",
+		ReservedPorts: []node.PortRange{{Start: 8000, End: 8100}},
+		HostNetworks: []node.HostNetwork{
+			{Name: "public", IPs: []string{"192.168.1.10"}, ReservedPorts: []node.PortRange{{Start: 9000, End: 9010}}},
+		},
+	}
+
+	tests := []struct {
+		name        string
+		requestedIp string
+		start, end  int
+		reserved    bool
+	}{
+		{"range overlaps the node's own reserved range", "0.0.0.0", 8050, 8200, true},
+		{"range overlaps a host network's reserved range on its own IP", "192.168.1.10", 9005, 9020, true},
+		{"range overlaps a host network's reserved range but binds elsewhere", "10.0.0.5", 9005, 9020, false},
+		{"range doesn't overlap anything", "0.0.0.0", 100, 200, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, ok := rangeReserved(n, tt.requestedIp, tt.start, tt.end)
+			assert.Equal(t, tt.reserved, ok)
+		})
+	}
+}
+
+func TestFirstFreeRun(t *testing.T) {
+	tests := []struct {
+		name       string
+		used       map[int]interface{}
+		start, end int
+		size       int
+		wantStart  int
+		wantOk     bool
+	}{
+		{"entire range free picks the start", map[int]interface{}{}, 8000, 8010, 3, 8000, true},
+		{"single used port shifts the run past it", map[int]interface{}{8000: true}, 8000, 8010, 3, 8001, true},
+		{"gap too small for the run is skipped", map[int]interface{}{8001: true}, 8000, 8010, 3, 8002, true},
+		{"no run of the requested size fits", map[int]interface{}{8000: true, 8001: true, 8002: true, 8003: true, 8004: true}, 8000, 8004, 2, 0, false},
+		{"exact fit with size equal to the range", map[int]interface{}{}, 8000, 8002, 3, 8000, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, ok := firstFreeRun(tt.used, tt.start, tt.end, tt.size)
+			assert.Equal(t, tt.wantOk, ok)
+			if tt.wantOk {
+				assert.Equal(t, tt.wantStart, start)
+			}
+		})
+	}
+}
+
+func TestPortFilterBridgeRangePartialSubRange(t *testing.T) {
+	// Node 1 has already taken the lower half of the requested range;
+	// only the upper half remains, which is still big enough.
+	n1 := &node.Node{ID: "node-1"}
+	n1.Containers = []*cluster.Container{bridgeContainer("80", "8000-8004", "tcp")}
+
+	// Node 2 has taken enough of the range that no sub-range of the
+	// requested size is left.
+	n2 := &node.Node{ID: "node-2"}
+	n2.Containers = []*cluster.Container{bridgeContainer("80", "8000-8009", "tcp")}
+
+	p := &PortFilter{}
+	result, err := p.Filter(bridgeConfig("8000-8009", "80", "tcp"), []*node.Node{n1, n2})
+	assert.NoError(t, err)
+	assert.Len(t, result, 1)
+	assert.Equal(t, "node-1", result[0].ID)
+}
+
+func TestPortFilterBridgeRangeNoFitAcrossCandidates(t *testing.T) {
+	n1 := &node.Node{ID: "node-1"}
+	n1.Containers = []*cluster.Container{bridgeContainer("80", "8000-8009", "tcp")}
+
+	p := &PortFilter{}
+	_, err := p.Filter(bridgeConfig("8000-8009", "80", "tcp"), []*node.Node{n1})
+	assert.Error(t, err)
+}
+
+func twoDynamicBindingsConfig(containerPortA, containerPortB, proto string) *cluster.ContainerConfig {
+	config := &cluster.ContainerConfig{}
+	config.HostConfig.PortBindings = map[string][]dockerclient.PortBinding{
+		containerPortA + "/" + proto: {{}},
+		containerPortB + "/" + proto: {{}},
+	}
+	return config
+}
+
+func TestPortFilterBridgeDynamicPortAllocated(t *testing.T) {
+	n := &node.Node{ID: "node-1"}
+	p := &PortFilter{Allocator: portalloc.NewMemoryAllocator(9000, 9001)}
+
+	config := bridgeConfig("", "80", "tcp")
+	result, err := p.Filter(config, []*node.Node{n})
+	assert.NoError(t, err)
+	assert.Len(t, result, 1)
+
+	port := config.HostConfig.PortBindings["80/tcp"][0].HostPort
+	assert.Contains(t, []string{"9000", "9001"}, port)
+}
+
+func TestPortFilterBridgeTwoDynamicBindingsPinSameNode(t *testing.T) {
+	n1 := &node.Node{ID: "node-1"}
+	n2 := &node.Node{ID: "node-2"}
+	p := &PortFilter{Allocator: portalloc.NewMemoryAllocator(9000, 9001)}
+
+	config := twoDynamicBindingsConfig("80", "443", "tcp")
+	result, err := p.Filter(config, []*node.Node{n1, n2})
+	assert.NoError(t, err)
+	assert.Len(t, result, 1)
+
+	portA := config.HostConfig.PortBindings["80/tcp"][0].HostPort
+	portB := config.HostConfig.PortBindings["443/tcp"][0].HostPort
+	assert.NotEqual(t, "", portA)
+	assert.NotEqual(t, "", portB)
+	assert.NotEqual(t, portA, portB)
+	assert.Equal(t, result[0].ID, n1.ID)
+}
+
+func TestPortFilterBridgeDynamicPartialFailureReleasesPorts(t *testing.T) {
+	n := &node.Node{ID: "node-1"}
+	allocator := portalloc.NewMemoryAllocator(9000, 9000)
+	p := &PortFilter{Allocator: allocator}
+
+	// Only one port exists in the range, but the container asks for two:
+	// the first binding succeeds, the second can't be satisfied on the
+	// node the first one pinned to.
+	config := twoDynamicBindingsConfig("80", "443", "tcp")
+	_, err := p.Filter(config, []*node.Node{n})
+	assert.Error(t, err)
+
+	// The port taken by the first binding must have been released rather
+	// than leaked, so it's immediately available again.
+	ports, err := allocator.Allocate(n, "tcp", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{9000}, ports)
+}
+
+func TestPortFilterHostModeReservedPort(t *testing.T) {
+	n := &node.Node{ID: "node-1", ReservedPorts: []node.PortRange{{Start: 22, End: 22}}}
+	p := &PortFilter{}
+
+	result, err := p.Filter(hostConfig("22/tcp"), []*node.Node{n})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "reserved for the host")
+	assert.Len(t, result, 0)
+}
+
+func TestPortFilterBridgeReservedRange(t *testing.T) {
+	n := &node.Node{ID: "node-1", ReservedPorts: []node.PortRange{{Start: 8000, End: 8100}}}
+	p := &PortFilter{}
+
+	result, err := p.Filter(bridgeConfig("8050", "80", "tcp"), []*node.Node{n})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "reserved for the host")
+	assert.Len(t, result, 0)
+}
+
+func TestPortFilterBridgeUnsupportedProtocol(t *testing.T) {
+	n := &node.Node{ID: "node-1"}
+	p := &PortFilter{}
+
+	_, err := p.Filter(bridgeConfig("8080", "80", "icmp"), []*node.Node{n})
+	assert.Error(t, err)
+}
+
+func TestPortFilterBridgeIPOverlap(t *testing.T) {
+	tests := []struct {
+		name        string
+		existingIp  string
+		requestedIp string
+		collides    bool
+	}{
+		{"distinct specific IPv4 addresses coexist", "192.168.1.10", "10.0.0.5", false},
+		{"same specific IPv4 address collides", "192.168.1.10", "192.168.1.10", true},
+		{"wildcard collides with any specific address", "0.0.0.0", "192.168.1.10", true},
+		{"specific address collides with wildcard", "10.0.0.5", "0.0.0.0", true},
+		{"bracketed IPv6 literal matches unbracketed equivalent", "::1", "[::1]", true},
+		{"distinct IPv6 literals coexist", "[2001:db8::1]", "[2001:db8::2]", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := &node.Node{ID: "node-1"}
+			n.Containers = []*cluster.Container{bridgeContainerOnIP("80", tt.existingIp, "8080", "tcp")}
+
+			p := &PortFilter{}
+			result, err := p.Filter(bridgeConfigOnIP(tt.requestedIp, "8080", "80", "tcp"), []*node.Node{n})
+			if tt.collides {
+				assert.Error(t, err)
+				assert.Len(t, result, 0)
+			} else {
+				assert.NoError(t, err)
+				assert.Len(t, result, 1)
+			}
+		})
+	}
+}
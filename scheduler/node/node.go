@@ -0,0 +1,197 @@
+package node
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/docker/swarm/cluster"
+)
+
+// ReservedPortsLabel is the engine label used to declare the host ports
+// that are carved out for the operator's own use (SSH, monitoring agents,
+// etc.) and must never be handed out to a scheduled container, e.g.
+// `swarm.reserved_ports=80,443,8000-8100`.
+const ReservedPortsLabel = "swarm.reserved_ports"
+
+// PortRange is an inclusive range of ports, e.g. 8000-8100. A single port
+// is represented with Start == End.
+type PortRange struct {
+	Start int
+	End   int
+}
+
+// Contains returns true if port falls within the range.
+func (r PortRange) Contains(port int) bool {
+	return port >= r.Start && port <= r.End
+}
+
+// String implements fmt.Stringer.
+func (r PortRange) String() string {
+	if r.Start == r.End {
+		return strconv.Itoa(r.Start)
+	}
+	return fmt.Sprintf("%d-%d", r.Start, r.End)
+}
+
+// HostNetwork mirrors Nomad's host_network blocks: a named, host-local
+// network (typically bound to one or more specific interface addresses)
+// that carries its own list of reserved ports, independent of the node's
+// default reserved ports.
+type HostNetwork struct {
+	Name          string
+	IPs           []string
+	ReservedPorts []PortRange
+}
+
+// HasIP returns true if ip matches one of the host network's interface
+// addresses.
+func (hn HostNetwork) HasIP(ip net.IP) bool {
+	for _, raw := range hn.IPs {
+		if known := net.ParseIP(raw); known != nil && known.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Node is swarm's representation of a cluster node. It tracks everything
+// the scheduler's filters need to know about a node without talking to its
+// engine directly.
+type Node struct {
+	ID   string
+	IP   string
+	Addr string
+	Name string
+
+	Labels map[string]string
+
+	Containers []*cluster.Container
+
+	// ReservedPorts are the ports the operator has carved out for the host
+	// itself. Populated from ReservedPortsLabel by NewNode/ParseReservedPorts.
+	ReservedPorts []PortRange
+
+	// HostNetworks are named, per-host-IP reserved port sets. Populated by
+	// SetHostNetworks from the shared result of HostNetworksFromConfig.
+	HostNetworks []HostNetwork
+
+	// HostIPs are the addresses of the node's own network interfaces, as
+	// reported by the engine. Used to tell whether a requested bind IP
+	// actually refers to one of this node's interfaces.
+	HostIPs []net.IP
+}
+
+// NewNode returns a Node for id/addr with ReservedPorts already parsed out
+// of labels. This is the constructor swarm's engine-registration path is
+// expected to call whenever it (re)discovers a node's current label set;
+// that call site lives in swarm's cluster package, which this snapshot of
+// the tree does not include.
+func NewNode(id, addr string, labels map[string]string) (*Node, error) {
+	n := &Node{ID: id, Addr: addr, Labels: labels}
+	if err := n.ParseReservedPorts(); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// SetHostNetworks assigns networks, typically the shared result of a single
+// HostNetworksFromConfig call at manager startup, as n's HostNetworks.
+func (n *Node) SetHostNetworks(networks []HostNetwork) {
+	n.HostNetworks = networks
+}
+
+// HasIP returns true if ip is one of the node's known interface addresses.
+func (n *Node) HasIP(ip net.IP) bool {
+	for _, known := range n.HostIPs {
+		if known.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseReservedPorts reads the ReservedPortsLabel out of n.Labels and
+// populates n.ReservedPorts. It is a no-op if the label is absent.
+func (n *Node) ParseReservedPorts() error {
+	spec, ok := n.Labels[ReservedPortsLabel]
+	if !ok || spec == "" {
+		return nil
+	}
+	ranges, err := ParsePortRanges(spec)
+	if err != nil {
+		return fmt.Errorf("node %s: invalid %s: %v", n.ID, ReservedPortsLabel, err)
+	}
+	n.ReservedPorts = ranges
+	return nil
+}
+
+// ParsePortRanges parses a comma-separated list of ports and port ranges,
+// e.g. "80,443,8000-8100", into a compact slice of PortRange.
+func ParsePortRanges(spec string) ([]PortRange, error) {
+	var ranges []PortRange
+	for _, field := range strings.Split(spec, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		parts := strings.SplitN(field, "-", 2)
+		start, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q", field)
+		}
+		end := start
+		if len(parts) == 2 {
+			end, err = strconv.Atoi(strings.TrimSpace(parts[1]))
+			if err != nil {
+				return nil, fmt.Errorf("invalid port range %q", field)
+			}
+		}
+		if end < start {
+			return nil, fmt.Errorf("invalid port range %q: end before start", field)
+		}
+		ranges = append(ranges, PortRange{Start: start, End: end})
+	}
+	return ranges, nil
+}
+
+// hostNetworksConfig is the on-disk shape of the host networks config file.
+type hostNetworksConfig struct {
+	HostNetworks []struct {
+		Name          string   `json:"name"`
+		IPs           []string `json:"ips"`
+		ReservedPorts string   `json:"reserved_ports"`
+	} `json:"host_networks"`
+}
+
+// HostNetworksFromConfig loads host network definitions, à la Nomad's
+// host_network blocks, from a JSON config file read at engine registration.
+func HostNetworksFromConfig(path string) ([]HostNetwork, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var raw hostNetworksConfig
+	if err := json.NewDecoder(f).Decode(&raw); err != nil {
+		return nil, fmt.Errorf("parsing host networks config %s: %v", path, err)
+	}
+
+	networks := make([]HostNetwork, 0, len(raw.HostNetworks))
+	for _, hn := range raw.HostNetworks {
+		ranges, err := ParsePortRanges(hn.ReservedPorts)
+		if err != nil {
+			return nil, fmt.Errorf("host network %q: %v", hn.Name, err)
+		}
+		networks = append(networks, HostNetwork{
+			Name:          hn.Name,
+			IPs:           hn.IPs,
+			ReservedPorts: ranges,
+		})
+	}
+	return networks, nil
+}
@@ -0,0 +1,108 @@
+package node
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePortRanges(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    string
+		want    []PortRange
+		wantErr bool
+	}{
+		{"single port", "80", []PortRange{{Start: 80, End: 80}}, false},
+		{"range", "8000-8100", []PortRange{{Start: 8000, End: 8100}}, false},
+		{"mixed list with spaces", "80, 443, 8000-8100", []PortRange{{Start: 80, End: 80}, {Start: 443, End: 443}, {Start: 8000, End: 8100}}, false},
+		{"empty spec", "", nil, false},
+		{"invalid port", "abc", nil, true},
+		{"invalid range", "80-abc", nil, true},
+		{"end before start", "100-50", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParsePortRanges(tt.spec)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestNewNodeParsesReservedPortsLabel(t *testing.T) {
+	n, err := NewNode("node-1", "1.2.3.4:2375", map[string]string{
+		ReservedPortsLabel: "22,8000-8100",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []PortRange{{Start: 22, End: 22}, {Start: 8000, End: 8100}}, n.ReservedPorts)
+}
+
+func TestNewNodeRejectsInvalidReservedPortsLabel(t *testing.T) {
+	_, err := NewNode("node-1", "1.2.3.4:2375", map[string]string{
+		ReservedPortsLabel: "not-a-port",
+	})
+	assert.Error(t, err)
+}
+
+func TestNodeHasIP(t *testing.T) {
+	n := &Node{HostIPs: []net.IP{net.ParseIP("192.168.1.10"), net.ParseIP("10.0.0.5")}}
+
+	assert.True(t, n.HasIP(net.ParseIP("192.168.1.10")))
+	assert.False(t, n.HasIP(net.ParseIP("172.16.0.1")))
+}
+
+func TestHostNetworkHasIP(t *testing.T) {
+	hn := HostNetwork{IPs: []string{"192.168.1.10"}}
+
+	assert.True(t, hn.HasIP(net.ParseIP("192.168.1.10")))
+	assert.False(t, hn.HasIP(net.ParseIP("10.0.0.5")))
+}
+
+func TestHostNetworksFromConfig(t *testing.T) {
+	f, err := ioutil.TempFile("", "host-networks-*.json")
+	assert.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	_, err = f.WriteString(`{
+		"host_networks": [
+			{"name": "public", "ips": ["192.168.1.10"], "reserved_ports": "80,443"}
+		]
+	}`)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	networks, err := HostNetworksFromConfig(f.Name())
+	assert.NoError(t, err)
+	assert.Equal(t, []HostNetwork{{
+		Name:          "public",
+		IPs:           []string{"192.168.1.10"},
+		ReservedPorts: []PortRange{{Start: 80, End: 80}, {Start: 443, End: 443}},
+	}}, networks)
+}
+
+func TestHostNetworksFromConfigInvalidReservedPorts(t *testing.T) {
+	f, err := ioutil.TempFile("", "host-networks-*.json")
+	assert.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	_, err = f.WriteString(`{"host_networks": [{"name": "public", "reserved_ports": "not-a-port"}]}`)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	_, err = HostNetworksFromConfig(f.Name())
+	assert.Error(t, err)
+}
+
+func TestHostNetworksFromConfigMissingFile(t *testing.T) {
+	_, err := HostNetworksFromConfig("/does/not/exist.json")
+	assert.Error(t, err)
+}
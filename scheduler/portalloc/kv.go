@@ -0,0 +1,62 @@
+package portalloc
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+
+	"github.com/docker/libkv/store"
+	"github.com/docker/swarm/scheduler/node"
+)
+
+// KVAllocator is an Allocator backed by the same KV discovery backend
+// Swarm already uses for leader election, so that a manager failover
+// cannot double-allocate a dynamic host port: every allocation is a
+// create-only (AtomicPut with no previous value) write, which only one
+// manager can win.
+type KVAllocator struct {
+	store      store.Store
+	prefix     string
+	start, end int
+}
+
+// NewKVAllocator returns a KVAllocator handing out ports from
+// [start, end], storing its allocations under prefix in store.
+func NewKVAllocator(s store.Store, prefix string, start, end int) *KVAllocator {
+	return &KVAllocator{store: s, prefix: prefix, start: start, end: end}
+}
+
+func (a *KVAllocator) key(n *node.Node, proto string, port int) string {
+	return path.Join(a.prefix, n.ID, proto, strconv.Itoa(port))
+}
+
+// Allocate is exported
+func (a *KVAllocator) Allocate(n *node.Node, proto string, count int) ([]int, error) {
+	ports := make([]int, 0, count)
+	for p := a.start; p <= a.end && len(ports) < count; p++ {
+		ok, _, err := a.store.AtomicPut(a.key(n, proto, p), []byte(proto), nil, nil)
+		if err != nil {
+			if err == store.ErrKeyExists {
+				continue
+			}
+			a.Release(n, proto, ports)
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		ports = append(ports, p)
+	}
+	if len(ports) < count {
+		a.Release(n, proto, ports)
+		return nil, fmt.Errorf("node %s: unable to allocate %d %s port(s) from range %d-%d", n.ID, count, proto, a.start, a.end)
+	}
+	return ports, nil
+}
+
+// Release is exported
+func (a *KVAllocator) Release(n *node.Node, proto string, ports []int) {
+	for _, p := range ports {
+		a.store.Delete(a.key(n, proto, p))
+	}
+}
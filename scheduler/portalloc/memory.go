@@ -0,0 +1,134 @@
+package portalloc
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/nat"
+	"github.com/docker/swarm/scheduler/node"
+)
+
+// reconcileGrace is how long a MemoryAllocator keeps an allocation it
+// cannot yet confirm via a node's observed container bindings. A
+// just-made allocation has no container on the node yet — it hasn't been
+// created, let alone reported back through a refresh — so reconciling it
+// away before the grace period elapses would hand the same port out to a
+// second, concurrently-scheduled container.
+const reconcileGrace = 30 * time.Second
+
+// portKey identifies a single host port/protocol pair. 53/tcp and 53/udp
+// are independent pools: allocating one must never block the other.
+type portKey struct {
+	port  int
+	proto string
+}
+
+// MemoryAllocator is the default Allocator: an in-memory pool of
+// [start, end] keyed by node ID. Call Reconcile from the cluster's
+// node-refresh loop to return ports freed by containers dying outside of
+// Swarm's knowledge to the pool, and to keep ports taken by containers
+// Swarm didn't allocate (e.g. pre-existing ones) from ever being handed
+// out. Reconcile never touches an allocation younger than reconcileGrace,
+// so it cannot race a just-issued Allocate.
+//
+// MemoryAllocator does not survive a leader failover: use KVAllocator if
+// the cluster runs with multiple managers.
+type MemoryAllocator struct {
+	start, end int
+
+	mu        sync.Mutex
+	allocated map[string]map[portKey]time.Time
+}
+
+// NewMemoryAllocator returns a MemoryAllocator handing out ports from
+// [start, end], inclusive.
+func NewMemoryAllocator(start, end int) *MemoryAllocator {
+	return &MemoryAllocator{
+		start:     start,
+		end:       end,
+		allocated: make(map[string]map[portKey]time.Time),
+	}
+}
+
+// Allocate is exported
+func (a *MemoryAllocator) Allocate(n *node.Node, proto string, count int) ([]int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	used, ok := a.allocated[n.ID]
+	if !ok {
+		used = make(map[portKey]time.Time)
+		a.allocated[n.ID] = used
+	}
+
+	ports := make([]int, 0, count)
+	for p := a.start; p <= a.end && len(ports) < count; p++ {
+		if _, taken := used[portKey{port: p, proto: proto}]; !taken {
+			ports = append(ports, p)
+		}
+	}
+	if len(ports) < count {
+		return nil, fmt.Errorf("node %s: unable to allocate %d %s port(s) from range %d-%d", n.ID, count, proto, a.start, a.end)
+	}
+	now := time.Now()
+	for _, p := range ports {
+		used[portKey{port: p, proto: proto}] = now
+	}
+	return ports, nil
+}
+
+// Release is exported
+func (a *MemoryAllocator) Release(n *node.Node, proto string, ports []int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	used := a.allocated[n.ID]
+	for _, p := range ports {
+		delete(used, portKey{port: p, proto: proto})
+	}
+}
+
+// Reconcile drops any allocation on n that is both older than
+// reconcileGrace and no longer observed bound to one of n's containers.
+// It is meant to be called from the cluster's periodic node-refresh, not
+// from Allocate, so a pending allocation survives long enough for its
+// container to actually be created and reported back.
+func (a *MemoryAllocator) Reconcile(n *node.Node) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	used, ok := a.allocated[n.ID]
+	if !ok {
+		used = make(map[portKey]time.Time)
+		a.allocated[n.ID] = used
+	}
+
+	observed := make(map[portKey]bool)
+	for _, c := range n.Containers {
+		for rawPort, bindings := range c.Info.NetworkSettings.Ports {
+			proto, _ := nat.SplitProtoPort(rawPort)
+			for _, b := range bindings {
+				if port, err := parsePort(b.HostPort); err == nil {
+					observed[portKey{port: port, proto: proto}] = true
+				}
+			}
+		}
+	}
+
+	now := time.Now()
+	for k := range observed {
+		if _, taken := used[k]; !taken && k.port >= a.start && k.port <= a.end {
+			used[k] = now
+		}
+	}
+	for k, allocatedAt := range used {
+		if observed[k] {
+			continue
+		}
+		if now.Sub(allocatedAt) < reconcileGrace {
+			continue
+		}
+		delete(used, k)
+	}
+}
@@ -0,0 +1,101 @@
+package portalloc
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/docker/swarm/cluster"
+	"github.com/docker/swarm/scheduler/node"
+	"github.com/samalba/dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryAllocatorAllocateRelease(t *testing.T) {
+	a := NewMemoryAllocator(8000, 8001)
+	n := &node.Node{ID: "node-1"}
+
+	ports, err := a.Allocate(n, "tcp", 2)
+	assert.NoError(t, err)
+	assert.Len(t, ports, 2)
+
+	_, err = a.Allocate(n, "tcp", 1)
+	assert.Error(t, err)
+
+	a.Release(n, "tcp", ports)
+
+	ports, err = a.Allocate(n, "tcp", 2)
+	assert.NoError(t, err)
+	assert.Len(t, ports, 2)
+}
+
+func TestMemoryAllocatorProtocolsAreIndependent(t *testing.T) {
+	a := NewMemoryAllocator(8000, 8000)
+	n := &node.Node{ID: "node-1"}
+
+	_, err := a.Allocate(n, "tcp", 1)
+	assert.NoError(t, err)
+
+	// The same port number on a different protocol must still be free.
+	_, err = a.Allocate(n, "udp", 1)
+	assert.NoError(t, err)
+
+	// But the pool is now exhausted for both protocols individually.
+	_, err = a.Allocate(n, "tcp", 1)
+	assert.Error(t, err)
+	_, err = a.Allocate(n, "udp", 1)
+	assert.Error(t, err)
+}
+
+func TestMemoryAllocatorReconcileKeepsFreshAllocations(t *testing.T) {
+	a := NewMemoryAllocator(8000, 8000)
+	n := &node.Node{ID: "node-1"}
+
+	_, err := a.Allocate(n, "tcp", 1)
+	assert.NoError(t, err)
+
+	// No container reports the port yet, but the allocation is brand new:
+	// reconciling now must not free it out from under the in-flight create.
+	a.Reconcile(n)
+
+	_, err = a.Allocate(n, "tcp", 1)
+	assert.Error(t, err)
+}
+
+func TestMemoryAllocatorReconcileFreesStaleUnobservedAllocations(t *testing.T) {
+	a := NewMemoryAllocator(8000, 8000)
+	n := &node.Node{ID: "node-1"}
+
+	ports, err := a.Allocate(n, "tcp", 1)
+	assert.NoError(t, err)
+
+	a.allocated[n.ID][portKey{port: ports[0], proto: "tcp"}] = time.Now().Add(-2 * reconcileGrace)
+	a.Reconcile(n)
+
+	_, err = a.Allocate(n, "tcp", 1)
+	assert.NoError(t, err)
+}
+
+func TestMemoryAllocatorReconcileKeepsObservedAllocations(t *testing.T) {
+	a := NewMemoryAllocator(8000, 8000)
+	n := &node.Node{ID: "node-1"}
+
+	ports, err := a.Allocate(n, "tcp", 1)
+	assert.NoError(t, err)
+
+	a.allocated[n.ID][portKey{port: ports[0], proto: "tcp"}] = time.Now().Add(-2 * reconcileGrace)
+	n.Containers = []*cluster.Container{{
+		Info: dockerclient.ContainerInfo{
+			NetworkSettings: &dockerclient.NetworkSettings{
+				Ports: map[string][]dockerclient.PortBinding{
+					"80/tcp": {{HostIp: "0.0.0.0", HostPort: strconv.Itoa(ports[0])}},
+				},
+			},
+		},
+	}}
+
+	a.Reconcile(n)
+
+	_, err = a.Allocate(n, "tcp", 1)
+	assert.Error(t, err)
+}
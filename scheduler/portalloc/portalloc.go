@@ -0,0 +1,21 @@
+// Package portalloc provides pluggable allocation of dynamic host ports
+// (the `-p 80` case, where the host side is left for Swarm to pick) so
+// that the port can be pre-assigned before a container is created, rather
+// than leaving two containers scheduled concurrently to the same node to
+// race for the same port at the engine level.
+package portalloc
+
+import (
+	"github.com/docker/swarm/scheduler/node"
+)
+
+// Allocator assigns and releases host ports on cluster nodes.
+type Allocator interface {
+	// Allocate reserves count free ports of the given protocol on n and
+	// returns them. It fails if fewer than count ports are available.
+	Allocate(n *node.Node, proto string, count int) ([]int, error)
+
+	// Release returns previously allocated ports of the given protocol on n
+	// back to the pool.
+	Release(n *node.Node, proto string, ports []int)
+}
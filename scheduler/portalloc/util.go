@@ -0,0 +1,9 @@
+package portalloc
+
+import "strconv"
+
+// parsePort parses a single numeric HostPort, as found in
+// dockerclient.PortBinding once a container has actually been started.
+func parsePort(hostPort string) (int, error) {
+	return strconv.Atoi(hostPort)
+}